@@ -0,0 +1,108 @@
+package service
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"sync/atomic"
+)
+
+// listenFDEnvKey 告诉子进程父进程通过 cmd.ExtraFiles 传递了多少个监听 fd。
+// 子进程据此改用 net.FileListener 复用这些 fd，而不是重新 net.Listen，
+// 这样端口切换期间不会有哪怕一瞬间是关闭或者拒绝连接的状态，实现 fvbock/endless 那种零停机重启
+const listenFDEnvKey = "GOLANG_HOMEWORKS_LISTEN_FDS"
+
+// listenFDIndex 按 NewServer 调用的先后顺序给继承来的 fd 编号，
+// 必须和父进程导出 ExtraFiles 时的顺序完全一致（都等于 app.servers 的顺序）
+var listenFDIndex int32 = -1
+
+func inheritedListenFDCount() int {
+	n, _ := strconv.Atoi(os.Getenv(listenFDEnvKey))
+	return n
+}
+
+// newListener 在被继承重启的子进程里复用父进程传下来的 socket，
+// 否则就是普通的 net.Listen
+func newListener(addr string) (net.Listener, error) {
+	if inheritedListenFDCount() > 0 {
+		idx := int(atomic.AddInt32(&listenFDIndex, 1))
+		// fd 0-2 分别是标准输入输出错误，ExtraFiles 从 fd 3 开始顺序排列
+		f := os.NewFile(uintptr(3+idx), fmt.Sprintf("listen-fd-%d", idx))
+		ln, err := net.FileListener(f)
+		if err != nil {
+			return nil, fmt.Errorf("复用继承的监听fd失败: %w", err)
+		}
+		return ln, nil
+	}
+	return net.Listen("tcp", addr)
+}
+
+// listenerFile 导出 Server 当前监听 socket 对应的 *os.File，用于传给子进程的 ExtraFiles。
+// 返回的文件是底层 fd 的 dup，父进程自己的 listener 不受影响，可以继续正常关闭
+func (s *Server) listenerFile() (*os.File, error) {
+	type filer interface {
+		File() (*os.File, error)
+	}
+	lf, ok := s.ln.(filer)
+	if !ok {
+		return nil, fmt.Errorf("listener类型%T不支持导出fd", s.ln)
+	}
+	return lf.File()
+}
+
+// registerRestartHandler 监听 SIGHUP 触发的滚动重启请求。
+// 收到信号后立刻 fork 出携带所有监听 socket 的子进程，子进程马上开始 Accept 新连接；
+// 父进程则照常走一遍优雅退出流程把存量请求处理完，全程端口不会被关闭
+func (app *App) registerRestartHandler() {
+	restartChan := make(chan os.Signal, 1)
+	signal.Notify(restartChan, app.reloadSignals...)
+	go func() {
+		for range restartChan {
+			log.Println("收到SIGHUP，开始滚动重启")
+			if err := app.forkRestart(); err != nil {
+				log.Printf("滚动重启失败，继续提供服务: %v", err)
+				continue
+			}
+			log.Println("新进程已接管监听端口，当前进程开始优雅退出")
+			app.gracefulShutdown()
+			os.Exit(0)
+		}
+	}()
+}
+
+// forkRestart 导出所有 Server 的监听 fd，用相同的命令行和环境变量拉起一个子进程，
+// 子进程通过 GOLANG_HOMEWORKS_LISTEN_FDS 得知需要继承多少个 fd。
+// files 里的每个 *os.File 都是监听 fd 的 dup，cmd.Start 会把它们复制给子进程，
+// 不管成功还是失败，父进程这边导出的副本都要自己关掉，否则每次失败的重启尝试都会泄漏 fd
+func (app *App) forkRestart() error {
+	files := make([]*os.File, 0, len(app.servers))
+	closeFiles := func() {
+		for _, f := range files {
+			_ = f.Close()
+		}
+	}
+	for _, s := range app.servers {
+		f, err := s.listenerFile()
+		if err != nil {
+			closeFiles()
+			return fmt.Errorf("导出服务器%s的监听fd失败: %w", s.name, err)
+		}
+		files = append(files, f)
+	}
+	defer closeFiles()
+
+	cmd := exec.Command(os.Args[0], os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(), fmt.Sprintf("%s=%d", listenFDEnvKey, len(files)))
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("拉起子进程失败: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package service
+
+import (
+	"crypto/tls"
+	"time"
+)
+
+// ServerOption 和 App 的 Option 是同一种模式，只是作用对象换成了单个 Server，
+// 用来配置那些只和具体 Server 相关、不该影响全局的参数（超时、TLS 等）
+type ServerOption func(*Server)
+
+// WithReadTimeout 对应 http.Server.ReadTimeout，不设置的话 Server 对 Slowloris 这类
+// 慢速请求攻击没有任何防御能力
+func WithReadTimeout(d time.Duration) ServerOption {
+	return func(s *Server) {
+		s.srv.ReadTimeout = d
+	}
+}
+
+// WithWriteTimeout 对应 http.Server.WriteTimeout
+func WithWriteTimeout(d time.Duration) ServerOption {
+	return func(s *Server) {
+		s.srv.WriteTimeout = d
+	}
+}
+
+// WithIdleTimeout 对应 http.Server.IdleTimeout，控制开启 keep-alive 之后
+// 一条空闲连接最多能占用多久
+func WithIdleTimeout(d time.Duration) ServerOption {
+	return func(s *Server) {
+		s.srv.IdleTimeout = d
+	}
+}
+
+// WithTLS 配置证书和私钥路径，Start 会据此改用 ServeTLS 而不是 Serve
+func WithTLS(certFile, keyFile string) ServerOption {
+	return func(s *Server) {
+		s.certFile = certFile
+		s.keyFile = keyFile
+	}
+}
+
+// WithTLSConfig 允许直接传入自定义的 tls.Config（双向认证、自定义密码套件等场景），
+// 和 WithTLS 可以一起用：证书路径走 WithTLS，其余策略走这里
+func WithTLSConfig(cfg *tls.Config) ServerOption {
+	return func(s *Server) {
+		s.srv.TLSConfig = cfg
+	}
+}
+
+// WithHTTP2 显式开启 HTTP/2 支持。标准库在 TLS 场景下默认已经支持 h2，
+// 这里用 golang.org/x/net/http2.ConfigureServer 是为了在自定义 TLSConfig 的情况下
+// 也能保证 h2 的 NextProtos 被正确设置。
+// 它只是打一个标记，真正的 ConfigureServer 调用延后到 NewServer 里所有 ServerOption
+// 都跑完之后再做，这样不管 WithHTTP2 和 WithTLSConfig 谁写在前面，效果都一样，
+// 不会出现后写的 WithTLSConfig 把前面 ConfigureServer 设置好的 NextProtos 覆盖掉的问题
+func WithHTTP2() ServerOption {
+	return func(s *Server) {
+		s.http2Enabled = true
+	}
+}
@@ -2,14 +2,19 @@ package service
 
 import (
 	"context"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
-	"runtime"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
+
+	"golang.org/x/net/http2"
 )
 
 // 典型的 Option 设计模式
@@ -18,29 +23,113 @@ type Option func(*App)
 // ShutdownCallback 采用 context.Context 来控制超时，而不是用 time.After 是因为
 // - 超时本质上是使用这个回调的人控制的
 // - 我们还希望用户知道，他的回调必须要在一定时间内处理完毕，而且他必须显式处理超时错误
-type ShutdownCallback func(ctx context.Context)
+// 返回的 error 由 App 统一收集并记录日志，回调自己不需要再 log 一遍
+type ShutdownCallback func(ctx context.Context) error
+
+// shutdownCallback 给每个 ShutdownCallback 附上名字和优先级，
+// 用于分组执行和在日志里区分是哪个回调失败了
+type shutdownCallback struct {
+	name     string
+	priority int
+	cb       ShutdownCallback
+}
 
-// 你需要实现这个方法
+// WithShutdownCallbacks 是兼容旧版本的写法，所有回调优先级相同（0），会并发执行，没有先后顺序保证。
+// 新代码建议用 WithShutdownCallback 显式指定优先级
 func WithShutdownCallbacks(cbs ...ShutdownCallback) Option {
-	// 执行返回的func可以将回调函数添加到app.cbs
 	return func(app *App) {
-		app.cbs = cbs
+		for _, cb := range cbs {
+			app.cbs = append(app.cbs, shutdownCallback{cb: cb})
+		}
+	}
+}
+
+// WithShutdownCallback 注册一个带名字和优先级的回调。
+// 优先级数字越大越先执行，同一优先级内的回调并发执行；
+// 不同优先级之间是严格的先后顺序，例如"把缓存刷到数据库"要比"关闭数据库连接池"优先级更高
+func WithShutdownCallback(name string, priority int, cb ShutdownCallback) Option {
+	return func(app *App) {
+		app.cbs = append(app.cbs, shutdownCallback{name: name, priority: priority, cb: cb})
 	}
 }
 
+// groupShutdownCallbacksByPriority 将回调按优先级从高到低分组，组间顺序执行，组内并发执行
+func groupShutdownCallbacksByPriority(cbs []shutdownCallback) [][]shutdownCallback {
+	if len(cbs) == 0 {
+		return nil
+	}
+	sorted := make([]shutdownCallback, len(cbs))
+	copy(sorted, cbs)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].priority > sorted[j].priority
+	})
+	var groups [][]shutdownCallback
+	for i := 0; i < len(sorted); {
+		j := i + 1
+		for j < len(sorted) && sorted[j].priority == sorted[i].priority {
+			j++
+		}
+		groups = append(groups, sorted[i:j])
+		i = j
+	}
+	return groups
+}
+
 // 这里我已经预先定义好了各种可配置字段
 type App struct {
 	servers []*Server
 
-	// 优雅退出整个超时时间，默认30秒
+	// 优雅退出整个超时时间，默认30秒，是整个优雅退出流程唯一的时间预算
 	shutdownTimeout time.Duration
 
-	// 优雅退出时候等待处理已有请求时间，默认10秒钟
-	waitTime time.Duration
+	// 排水阶段（等待存量请求处理完）最多能用多久，默认10秒钟。
+	// 真正起作用的是 shutdownTimeout 剩余预算和 drainDeadline 中较小的一个
+	drainDeadline time.Duration
 	// 自定义回调超时时间，默认三秒钟
 	cbTimeout time.Duration
 
-	cbs []ShutdownCallback
+	// 标记为未就绪之后，到真正开始拒绝新请求之间预留的时间，默认不开启（0）。
+	// 这段时间内就绪探针已经返回不就绪，但 mux 仍然正常处理请求，
+	// 给负载均衡 / kubelet 一个把本实例摘除出服务列表的窗口
+	preDrainDelay time.Duration
+
+	// shutdownSignals 收到其中任意一个信号就触发优雅退出，默认 SIGINT/SIGTERM/SIGQUIT。
+	// 不包含 SIGKILL（根本捕获不到）和 SIGUSR1/2（约定俗成是留给用户自定义动作的）
+	shutdownSignals []os.Signal
+	// reloadSignals 收到其中任意一个信号就触发滚动重启，默认只有 SIGHUP
+	reloadSignals []os.Signal
+
+	cbs []shutdownCallback
+}
+
+// WithShutdownSignals 覆盖触发优雅退出的信号集合
+func WithShutdownSignals(sigs ...os.Signal) Option {
+	return func(app *App) {
+		app.shutdownSignals = sigs
+	}
+}
+
+// WithReloadSignals 覆盖触发滚动重启的信号集合
+func WithReloadSignals(sigs ...os.Signal) Option {
+	return func(app *App) {
+		app.reloadSignals = sigs
+	}
+}
+
+// WithDrainDeadline 设置排水阶段（等待 http.Server.Shutdown 完成）的独立超时时间。
+// 它和 shutdownTimeout 剩余预算取较小值，避免某个 Server 的排水占满整个退出流程
+func WithDrainDeadline(d time.Duration) Option {
+	return func(app *App) {
+		app.drainDeadline = d
+	}
+}
+
+// WithPreDrainDelay 设置标记未就绪到开始拒绝新请求之间的等待时间，
+// 和 k8s 推荐的 preStop 流程对齐：先从服务发现/负载均衡里摘除，再真正停止处理请求
+func WithPreDrainDelay(d time.Duration) Option {
+	return func(app *App) {
+		app.preDrainDelay = d
+	}
 }
 
 // NewApp 创建 App 实例，注意设置默认值，同时使用这些选项
@@ -49,8 +138,10 @@ func NewApp(servers []*Server, opts ...Option) *App {
 		servers: servers,
 		// 这里写死了默认值
 		shutdownTimeout: 30 * time.Second,
-		waitTime:        10 * time.Second,
+		drainDeadline:   10 * time.Second,
 		cbTimeout:       3 * time.Second,
+		shutdownSignals: []os.Signal{syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT},
+		reloadSignals:   []os.Signal{syscall.SIGHUP},
 	}
 	// 添加回调函数, 本例中指传入了一个
 	for _, opt := range opts {
@@ -61,6 +152,8 @@ func NewApp(servers []*Server, opts ...Option) *App {
 
 // StartAndServe 你主要要实现这个方法
 func (app *App) StartAndServe() {
+	// 监听 SIGHUP 实现 fd 继承式的滚动重启，和下面的终止信号监听相互独立
+	app.registerRestartHandler()
 	for _, s := range app.servers {
 		srv := s
 		go func() {
@@ -77,42 +170,67 @@ func (app *App) StartAndServe() {
 	// 从这里开始优雅退出监听系统信号，强制退出以及超时强制退出。
 	// 优雅退出的具体步骤在 shutdown 里面实现
 	// 所以你需要在这里恰当的位置，调用 shutdown
-	signalChan := make(chan os.Signal, 1)
-	// 处理不同的操作系统
-	sysType := runtime.GOOS
-	switch sysType {
-	case "linux":
-		// linux写linux专有的终止signal
-		signal.Notify(signalChan, os.Interrupt, os.Kill, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGINT, syscall.SIGTERM)
-	case "windows":
-		// windows写windows专有的终止signal
-		signal.Notify(signalChan, os.Interrupt, os.Kill, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGINT, syscall.SIGTERM)
-	case "darwin":
-		// darwin写darwin专有的终止signal
-		signal.Notify(signalChan, os.Interrupt, os.Kill, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGINT, syscall.SIGTERM)
-	}
-	select {
-	case <-signalChan:
-		go func() {
-			select {
-			case <-signalChan:
-				// 再次监听到退出信号，直接退出
-				log.Println("二次强制退出触发")
-				os.Exit(1)
-			}
-		}()
-		// 在app.shutdownTimeout到了的时候强制退出
-		time.AfterFunc(app.shutdownTimeout, func() {
-			log.Println("最大限度超时, 强制退出触发")
+	ctx, stop := signal.NotifyContext(context.Background(), app.shutdownSignals...)
+	<-ctx.Done()
+	stop()
+
+	// 优雅退出，带强制退出兜底
+	app.gracefulShutdown()
+}
+
+// gracefulShutdown 给优雅退出套上两层兜底：再收到一次退出信号直接强制退出，
+// 以及 shutdownTimeout 到点也强制退出。
+// SIGINT/SIGTERM/SIGQUIT 触发的正常退出路径和 registerRestartHandler 里
+// SIGHUP 触发的重启排水路径共用这同一份逻辑，保证不管从哪个入口进来，
+// 都不会因为某个回调或连接不肯退出而让进程永远卡住
+func (app *App) gracefulShutdown() {
+	// 二次收到退出信号直接强制退出，用 NotifyContext 监听 shutdownSignals。
+	// forceCtx 在本函数内部创建，外部（包括测试）既拿不到它也无法注入替代的 ctx，
+	// 只有进程真的再收到一次 shutdownSignals 里的信号才会触发强制退出
+	forceCtx, forceStop := signal.NotifyContext(context.Background(), app.shutdownSignals...)
+	defer forceStop()
+	// done 用来在优雅退出正常走完之后让下面的 goroutine 安静退出，
+	// 避免 defer forceStop() 触发的 ctx 取消被误判成"又来了一次信号"从而强制退出
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-forceCtx.Done():
+			log.Println("二次强制退出触发")
 			os.Exit(1)
-		})
-		// 优雅退出
-		app.shutdown()
-	}
+		case <-done:
+		}
+	}()
+	// 在app.shutdownTimeout到了的时候强制退出
+	timer := time.AfterFunc(app.shutdownTimeout, func() {
+		log.Println("最大限度超时, 强制退出触发")
+		os.Exit(1)
+	})
+	defer timer.Stop()
+
+	app.shutdown()
 }
 
 // shutdown 你要设计这里面的执行步骤。
+// 整个流程共享同一个以 shutdownTimeout 为上限的 deadline，
+// 这样 rejectReq -> Shutdown -> 回调 三个阶段合起来才是真正意义上的 30 秒封顶，
+// 而不是各阶段各自再等一遍。
 func (app *App) shutdown() {
+	deadline := time.Now().Add(app.shutdownTimeout)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	log.Println("开始关闭应用，标记健康检查为未就绪")
+	// 先翻转就绪探针，让 k8s/负载均衡有机会把本实例摘出服务列表，
+	// 这一步必须严格发生在 rejectReq 之前
+	for _, s := range app.servers {
+		s.markUnready()
+	}
+	if app.preDrainDelay > 0 {
+		log.Println("等待 preDrainDelay，留出被摘除出服务列表的时间")
+		time.Sleep(app.preDrainDelay)
+	}
+
 	log.Println("开始关闭应用，停止接收新请求")
 	// 你需要在这里让所有的 server 拒绝新请求
 	for _, s := range app.servers {
@@ -120,35 +238,47 @@ func (app *App) shutdown() {
 		s.rejectReq()
 		log.Println("已经禁止server " + srv.name + "提供服务")
 	}
-	log.Println("等待正在执行请求完结")
-	// 在这里等待一段时间, 等待所有正在处理的业务处理完成
-	time.Sleep(app.waitTime)
 
-	log.Println("开始关闭服务器")
-	// 并发关闭服务器，同时要注意协调所有的 server 都关闭之后才能步入下一个阶段
+	log.Println("开始关闭服务器，等待正在执行的请求完结")
+	// drainCtx 在共享 deadline 的基础上，再叠加一个排水阶段自己的超时，
+	// 避免某个 server 迟迟不返回把整个预算都耗光
+	drainCtx := ctx
+	if remaining := time.Until(deadline); app.drainDeadline > 0 && app.drainDeadline < remaining {
+		var drainCancel context.CancelFunc
+		drainCtx, drainCancel = context.WithTimeout(ctx, app.drainDeadline)
+		defer drainCancel()
+	}
+	// 并发关闭服务器，http.Server.Shutdown 本身就会等待存量请求处理完成，
+	// 同时要注意协调所有的 server 都关闭之后才能步入下一个阶段
 	wg := sync.WaitGroup{}
 	for _, s := range app.servers {
 		wg.Add(1)
 		go func(srv *Server) {
 			defer wg.Done()
-			srv.stop()
+			if err := srv.stop(drainCtx); err != nil {
+				log.Printf("服务器%s关闭异常: %v", srv.name, err)
+			}
 		}(s)
 	}
 	wg.Wait()
 
 	log.Println("开始执行自定义回调")
-	// 并发执行回调，要注意协调所有的回调都执行完才会步入下一个阶段
-	bg := context.Background()
-	for _, cb := range app.cbs {
-		wg.Add(1)
-		// TODO: 不知道这样不cancel timeout context是否会有问题
-		timeoutCtx, _ := context.WithTimeout(bg, app.cbTimeout)
-		go func(cb ShutdownCallback) {
-			cb(timeoutCtx)
-			wg.Done()
-		}(cb)
+	// 按优先级分组，组间顺序执行，组内并发执行，同时要保证每一组执行完才会进入下一组
+	for _, group := range groupShutdownCallbacksByPriority(app.cbs) {
+		var groupWg sync.WaitGroup
+		for _, entry := range group {
+			groupWg.Add(1)
+			go func(entry shutdownCallback) {
+				defer groupWg.Done()
+				cbCtx, cbCancel := context.WithTimeout(ctx, app.cbTimeout)
+				defer cbCancel()
+				if err := entry.cb(cbCtx); err != nil {
+					log.Printf("回调[%s](优先级%d)执行失败: %v", entry.name, entry.priority, err)
+				}
+			}(entry)
+		}
+		groupWg.Wait()
 	}
-	wg.Wait()
 
 	// 释放资源
 	log.Println("开始释放资源")
@@ -162,51 +292,154 @@ func (app *App) close() {
 }
 
 type Server struct {
-	srv  *http.Server
-	name string
-	mux  *serverMux
+	srv    *http.Server
+	name   string
+	addr   string
+	mux    *serverMux
+	health *HealthProbe
+	// ln 是 Server 实际监听的 socket，平时由 net.Listen 创建，
+	// 滚动重启时则是从父进程继承来的，详见 restart.go
+	ln net.Listener
+
+	// certFile、keyFile 非空时 Start 会走 ServeTLS，详见 server_options.go 里的 WithTLS
+	certFile string
+	keyFile  string
+	// http2Enabled 由 WithHTTP2 标记，实际的 http2.ConfigureServer 调用放在 NewServer
+	// 里所有 ServerOption 都执行完之后，不受 WithHTTP2/WithTLSConfig 先后顺序影响
+	http2Enabled bool
 }
 
 // serverMux 既可以看做是装饰器模式，也可以看做委托模式
 type serverMux struct {
-	reject bool
+	// reject 由退出流程的 goroutine 写、被每一个 ServeHTTP 请求 goroutine 并发读，
+	// 所以用 atomic.Bool 而不是裸 bool
+	reject atomic.Bool
+	// healthPaths 记录通过 EnableHealthProbes 注册的探针路径，
+	// 这些路径即便在 reject 之后也要继续放行，否则 liveness 探针会被误判为失败
+	healthPaths map[string]struct{}
 	*http.ServeMux
 }
 
 func (s *serverMux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if s.reject {
-		w.WriteHeader(http.StatusServiceUnavailable)
-		_, _ = w.Write([]byte("服务已关闭"))
-		return
+	if s.reject.Load() {
+		if _, ok := s.healthPaths[r.URL.Path]; !ok {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte("服务已关闭"))
+			return
+		}
 	}
 	s.ServeMux.ServeHTTP(w, r)
 }
 
-func NewServer(name string, addr string) *Server {
-	mux := &serverMux{ServeMux: http.NewServeMux()}
-	return &Server{
+// HealthProbe 维护一个 Server 的就绪状态，配合 k8s 的 liveness/readiness 探针使用：
+// - liveness 只要进程还活着就应该返回 200，不受就绪状态影响
+// - readiness 在退出流程开始后先于 rejectReq 翻转为未就绪，好让编排系统先摘流量
+type HealthProbe struct {
+	mu    sync.RWMutex
+	ready bool
+}
+
+func newHealthProbe() *HealthProbe {
+	return &HealthProbe{ready: true}
+}
+
+func (h *HealthProbe) setReady(ready bool) {
+	h.mu.Lock()
+	h.ready = ready
+	h.mu.Unlock()
+}
+
+func (h *HealthProbe) isReady() bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.ready
+}
+
+func (h *HealthProbe) liveHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *HealthProbe) readyHandler(w http.ResponseWriter, r *http.Request) {
+	if h.isReady() {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	w.WriteHeader(http.StatusServiceUnavailable)
+}
+
+func NewServer(name string, addr string, opts ...ServerOption) *Server {
+	mux := &serverMux{ServeMux: http.NewServeMux(), healthPaths: map[string]struct{}{}}
+	ln, err := newListener(addr)
+	if err != nil {
+		// 监听失败（端口被占用、继承的fd无效等）是启动阶段的配置错误，没有必要让调用方
+		// 再额外处理一个 error 返回值，直接 panic 让它在启动时就暴露出来
+		panic(fmt.Sprintf("服务器%s监听%s失败: %v", name, addr, err))
+	}
+	s := &Server{
 		name: name,
+		addr: addr,
 		mux:  mux,
+		ln:   ln,
 		srv: &http.Server{
 			Addr:    addr,
 			Handler: mux,
 		},
 	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.http2Enabled {
+		// 放在所有 ServerOption 都执行完之后做，这样即便 WithTLSConfig 写在 WithHTTP2
+		// 后面整个替换了 s.srv.TLSConfig，这里的 ConfigureServer 仍然作用在最终的 TLSConfig 上
+		if err := http2.ConfigureServer(s.srv, &http2.Server{}); err != nil {
+			panic("开启HTTP2失败: " + err.Error())
+		}
+	}
+	return s
 }
 
 func (s *Server) Handle(pattern string, handler http.Handler) {
 	s.mux.Handle(pattern, handler)
 }
 
+// EnableHealthProbes 给 livePath 和 readyPath 注册探活/就绪路由。
+// livePath 一直返回 200，readyPath 在 Server 就绪状态翻转之后返回 503
+func (s *Server) EnableHealthProbes(livePath, readyPath string) {
+	s.health = newHealthProbe()
+	s.mux.healthPaths[livePath] = struct{}{}
+	s.mux.healthPaths[readyPath] = struct{}{}
+	s.mux.Handle(livePath, http.HandlerFunc(s.health.liveHandler))
+	s.mux.Handle(readyPath, http.HandlerFunc(s.health.readyHandler))
+}
+
+// markUnready 在优雅退出开始时把就绪探针翻转为未就绪，未启用健康检查时是个空操作
+func (s *Server) markUnready() {
+	if s.health != nil {
+		s.health.setReady(false)
+	}
+}
+
 func (s *Server) Start() error {
-	return s.srv.ListenAndServe()
+	if s.certFile != "" && s.keyFile != "" {
+		return s.srv.ServeTLS(s.ln, s.certFile, s.keyFile)
+	}
+	return s.srv.Serve(s.ln)
 }
 
 func (s *Server) rejectReq() {
-	s.mux.reject = true
+	s.mux.reject.Store(true)
+}
+
+// RegisterOnShutdown 注册一个在 Shutdown 被调用时触发的回调，转发给底层的 http.Server。
+// 主要用于通知那些 http.Server.Shutdown 本身管不到的长连接（如 WebSocket），
+// 让它们有机会自己走完排水流程
+func (s *Server) RegisterOnShutdown(f func()) {
+	s.srv.RegisterOnShutdown(f)
 }
 
-func (s *Server) stop() error {
+// stop 驱动 http.Server.Shutdown，ctx 的 deadline 由调用方（App.shutdown）统一控制，
+// 这样才能保证排水阶段不会突破 App 层面约定的总超时预算
+func (s *Server) stop(ctx context.Context) error {
 	log.Printf("服务器%s关闭中", s.name)
-	return s.srv.Shutdown(context.Background())
+	return s.srv.Shutdown(ctx)
 }
@@ -0,0 +1,61 @@
+package service
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestGroupShutdownCallbacksByPriority(t *testing.T) {
+	newCB := func(name string, priority int) shutdownCallback {
+		return shutdownCallback{
+			name:     name,
+			priority: priority,
+			cb:       func(ctx context.Context) error { return nil },
+		}
+	}
+
+	tests := []struct {
+		name string
+		cbs  []shutdownCallback
+		want [][]string
+	}{
+		{
+			name: "empty input",
+			cbs:  nil,
+			want: nil,
+		},
+		{
+			name: "mixed priorities, one per group, high priority first",
+			cbs:  []shutdownCallback{newCB("a", 1), newCB("b", 3), newCB("c", 2)},
+			want: [][]string{{"b"}, {"c"}, {"a"}},
+		},
+		{
+			name: "duplicate priorities land in the same group, stable order preserved",
+			cbs:  []shutdownCallback{newCB("a", 1), newCB("b", 2), newCB("c", 1), newCB("d", 2)},
+			want: [][]string{{"b", "d"}, {"a", "c"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := groupShutdownCallbacksByPriority(tt.cbs)
+
+			var gotNames [][]string
+			if len(got) > 0 {
+				gotNames = make([][]string, len(got))
+			}
+			for i, group := range got {
+				names := make([]string, len(group))
+				for j, entry := range group {
+					names[j] = entry.name
+				}
+				gotNames[i] = names
+			}
+
+			if !reflect.DeepEqual(gotNames, tt.want) {
+				t.Fatalf("groupShutdownCallbacksByPriority() = %v, want %v", gotNames, tt.want)
+			}
+		})
+	}
+}